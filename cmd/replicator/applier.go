@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// opKind distinguishes the two kinds of row change flushBatch applies.
+type opKind int
+
+const (
+	opUpsert opKind = iota
+	opDelete
+)
+
+// rowOp is a single staged row change, kept alongside its primary key so
+// the ops for one table can be replayed in the same relative order pgoutput
+// sent them, instead of bucketing every upsert ahead of every delete.
+type rowOp struct {
+	kind   opKind
+	key    []string
+	values map[string]*string // only set for kind == opUpsert
+}
+
+// tableBatch accumulates the row changes staged for one table within a
+// single source transaction, so they can be applied to the secondary as
+// one bulk operation instead of one round trip per row.
+type tableBatch struct {
+	mapping *TableMapping
+	ops     []rowOp
+}
+
+// batchSet accumulates every table touched by one source transaction, in
+// the order each table was first touched. Iterating in that order (rather
+// than Go's randomized map order) keeps cross-table apply order
+// deterministic and matched to the transaction's own statement order,
+// which matters when one table's rows carry a foreign key into another
+// table touched by the same transaction.
+type batchSet struct {
+	order  []string
+	tables map[string]*tableBatch
+}
+
+func newBatchSet() *batchSet {
+	return &batchSet{tables: make(map[string]*tableBatch)}
+}
+
+func (bs *batchSet) forTable(mapping *TableMapping) *tableBatch {
+	b, ok := bs.tables[mapping.SourceTable]
+	if !ok {
+		b = &tableBatch{mapping: mapping}
+		bs.tables[mapping.SourceTable] = b
+		bs.order = append(bs.order, mapping.SourceTable)
+	}
+	return b
+}
+
+func stageUpsert(bs *batchSet, mapping *TableMapping, values map[string]*string) error {
+	key, err := rowKey(mapping, values)
+	if err != nil {
+		return err
+	}
+	b := bs.forTable(mapping)
+	b.ops = append(b.ops, rowOp{kind: opUpsert, key: key, values: values})
+	return nil
+}
+
+func stageDelete(bs *batchSet, mapping *TableMapping, values map[string]*string) error {
+	key, err := rowKey(mapping, values)
+	if err != nil {
+		return err
+	}
+	b := bs.forTable(mapping)
+	b.ops = append(b.ops, rowOp{kind: opDelete, key: key})
+	return nil
+}
+
+func rowKey(mapping *TableMapping, values map[string]*string) ([]string, error) {
+	key := make([]string, len(mapping.PrimaryKey))
+	for i, pk := range mapping.PrimaryKey {
+		v, ok := values[pk]
+		if !ok || v == nil {
+			return nil, fmt.Errorf("missing primary key column %q in tuple for %s", pk, mapping.SourceTable)
+		}
+		key[i] = *v
+	}
+	return key, nil
+}
+
+// flushBatch applies every table's staged changes to the secondary inside
+// a single transaction, one table at a time in the order batch.order
+// records. In dry-run mode nothing is sent to the secondary; the batch
+// shape and the SQL it would run are logged instead.
+func (r *Replicator) flushBatch(ctx context.Context, batch *batchSet) error {
+	if batch == nil || len(batch.order) == 0 {
+		return nil
+	}
+
+	if r.dryRun {
+		for _, name := range batch.order {
+			r.logDryRunBatch(ctx, batch.tables[name])
+		}
+		return nil
+	}
+
+	tx, err := r.secondaryDB.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin secondary tx failed: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	for _, name := range batch.order {
+		b := batch.tables[name]
+		if err := applyTableBatch(ctx, tx, b); err != nil {
+			return fmt.Errorf("apply batch for %s failed: %w", b.mapping.DestTable, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit secondary tx failed: %w", err)
+	}
+	return nil
+}
+
+// applyTableBatch replays one table's staged ops as a sequence of runs:
+// each run is the longest prefix of ops whose primary keys are all
+// distinct. Within a run, an upsert and a delete never target the same
+// row, so the run's upserts can be merged in bulk and its deletes removed
+// in bulk with no risk of reordering a row's own history - e.g. an
+// insert-then-delete of the same key lands in two different runs and is
+// applied delete-after-insert, not the other way around.
+func applyTableBatch(ctx context.Context, tx pgx.Tx, b *tableBatch) error {
+	for runIdx, run := range splitRuns(b.ops) {
+		var upserts []map[string]*string
+		var deleteKeys [][]string
+		for _, op := range run {
+			switch op.kind {
+			case opUpsert:
+				upserts = append(upserts, op.values)
+			case opDelete:
+				deleteKeys = append(deleteKeys, op.key)
+			}
+		}
+
+		if len(upserts) > 0 {
+			if err := applyUpsertBatch(ctx, tx, b.mapping, upserts, runIdx); err != nil {
+				return fmt.Errorf("bulk upsert into %s failed: %w", b.mapping.DestTable, err)
+			}
+		}
+		if len(deleteKeys) > 0 {
+			if err := applyDeleteBatch(ctx, tx, b.mapping, deleteKeys); err != nil {
+				return fmt.Errorf("bulk delete from %s failed: %w", b.mapping.DestTable, err)
+			}
+		}
+	}
+	return nil
+}
+
+// splitRuns groups ops into the fewest runs such that no primary key
+// appears twice within a run, preserving each op's original position
+// relative to every other op on the same key.
+func splitRuns(ops []rowOp) [][]rowOp {
+	var runs [][]rowOp
+	var current []rowOp
+	seen := make(map[string]bool)
+
+	for _, op := range ops {
+		k := strings.Join(op.key, "\x00")
+		if seen[k] {
+			runs = append(runs, current)
+			current = nil
+			seen = make(map[string]bool)
+		}
+		seen[k] = true
+		current = append(current, op)
+	}
+	if len(current) > 0 {
+		runs = append(runs, current)
+	}
+	return runs
+}
+
+// upsertShape groups upsert rows that present the same set of destination
+// columns, keyed by column list so rows missing a TOASTed-and-unchanged
+// column are never mixed with rows that have it.
+type upsertShape struct {
+	cols []string
+	rows []map[string]*string
+}
+
+// groupByShape buckets upsert rows by which destination columns are
+// present in them. decodeTuple omits a column from a row's values map
+// entirely when pgoutput reported it as TOASTed-and-unchanged, meaning
+// "don't touch this column for this row" - grouping by shape lets each
+// group's merge statement only name the columns it actually has, instead
+// of a single uniform statement that would stage the missing columns as
+// NULL and then overwrite the real value in the destination with it.
+func groupByShape(mapping *TableMapping, upserts []map[string]*string) []upsertShape {
+	index := make(map[string]int)
+	var shapes []upsertShape
+
+	for _, row := range upserts {
+		var cols []string
+		for _, c := range mapping.Columns {
+			if _, ok := row[c.Source]; ok {
+				cols = append(cols, c.destName())
+			}
+		}
+		key := strings.Join(cols, ",")
+		idx, ok := index[key]
+		if !ok {
+			idx = len(shapes)
+			index[key] = idx
+			shapes = append(shapes, upsertShape{cols: cols})
+		}
+		shapes[idx].rows = append(shapes[idx].rows, row)
+	}
+	return shapes
+}
+
+// applyUpsertBatch stages a run's upsert rows into one or more TEXT-columned
+// temp tables via CopyFrom - one per distinct column shape and BatchSize
+// chunk - and merges each into the destination with its own INSERT ...
+// SELECT ... ON CONFLICT statement.
+//
+// Every value pgoutput hands us is text-encoded (decodeTuple only ever
+// produces *string), so each temp table is declared with TEXT columns
+// regardless of the destination's real types - copying *string into a
+// LIKE-the-destination temp table would ask CopyFrom's binary protocol to
+// encode a string into whatever typed column sits on the other side, which
+// fails for anything but text columns. The merge query casts each column
+// back to the destination's actual type, which Postgres resolves the same
+// way it would an untyped string literal.
+func applyUpsertBatch(ctx context.Context, tx pgx.Tx, mapping *TableMapping, upserts []map[string]*string, runIdx int) error {
+	colTypes, err := destColumnTypes(ctx, tx, mapping.DestTable)
+	if err != nil {
+		return fmt.Errorf("look up column types for %s: %w", mapping.DestTable, err)
+	}
+
+	srcByDest := make(map[string]string, len(mapping.Columns))
+	for _, c := range mapping.Columns {
+		srcByDest[c.destName()] = c.Source
+	}
+
+	pass := 0
+	for _, shape := range groupByShape(mapping, upserts) {
+		for _, col := range shape.cols {
+			if _, ok := colTypes[col]; !ok {
+				return fmt.Errorf("column %q not found on %s", col, mapping.DestTable)
+			}
+		}
+
+		for _, chunk := range chunkUpserts(shape.rows, mapping.BatchSize) {
+			tempTable := fmt.Sprintf("stage_%s_%d_%d", mapping.DestTable, runIdx, pass)
+			pass++
+
+			stageDefs := make([]string, len(shape.cols))
+			for i, col := range shape.cols {
+				stageDefs[i] = fmt.Sprintf("%s TEXT", col)
+			}
+			createTemp := fmt.Sprintf("CREATE TEMP TABLE %s (%s) ON COMMIT DROP", tempTable, strings.Join(stageDefs, ", "))
+			if _, err := tx.Exec(ctx, createTemp); err != nil {
+				return fmt.Errorf("create temp table: %w", err)
+			}
+
+			rows := make([][]any, len(chunk))
+			for i, values := range chunk {
+				row := make([]any, len(shape.cols))
+				for j, col := range shape.cols {
+					row[j] = values[srcByDest[col]]
+				}
+				rows[i] = row
+			}
+
+			if _, err := tx.CopyFrom(ctx, pgx.Identifier{tempTable}, shape.cols, pgx.CopyFromRows(rows)); err != nil {
+				return fmt.Errorf("copy into temp table: %w", err)
+			}
+
+			mergeQuery := upsertMergeQuery(mapping, shape.cols, colTypes, tempTable)
+			if _, err := tx.Exec(ctx, mergeQuery); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// chunkUpserts splits rows into slices of at most size, so a table with a
+// configured BatchSize is applied across multiple COPY + merge passes
+// instead of one unbounded pass. A non-positive size means "no limit".
+func chunkUpserts(rows []map[string]*string, size int) [][]map[string]*string {
+	if size <= 0 || size >= len(rows) {
+		return [][]map[string]*string{rows}
+	}
+
+	var chunks [][]map[string]*string
+	for start := 0; start < len(rows); start += size {
+		end := start + size
+		if end > len(rows) {
+			end = len(rows)
+		}
+		chunks = append(chunks, rows[start:end])
+	}
+	return chunks
+}
+
+// upsertMergeQuery builds the INSERT ... SELECT ... ON CONFLICT statement
+// that merges a shape's staged temp table into its destination. The temp
+// table's columns are all TEXT (see applyUpsertBatch), so the source of
+// the INSERT is a subquery that casts every column back to its real type
+// first; the mapping's Filter, if any, is then applied against that
+// casted subquery rather than the raw text columns, so a predicate like
+// "age > 18" compares integers instead of strings.
+func upsertMergeQuery(mapping *TableMapping, cols []string, colTypes map[string]string, tempTable string) string {
+	castExprs := make([]string, len(cols))
+	for i, col := range cols {
+		castExprs[i] = fmt.Sprintf("%s::%s AS %s", col, colTypes[col], col)
+	}
+	castedSource := fmt.Sprintf("(SELECT %s FROM %s) AS casted", strings.Join(castExprs, ", "), tempTable)
+
+	var updates []string
+	for _, col := range cols {
+		if !mapping.isPrimaryKey(col) {
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", col, col))
+		}
+	}
+	conflictAction := "DO NOTHING"
+	if len(updates) > 0 {
+		conflictAction = "DO UPDATE SET " + strings.Join(updates, ", ")
+	}
+
+	where := ""
+	if mapping.Filter != "" {
+		where = " WHERE " + mapping.Filter
+	}
+
+	return fmt.Sprintf(
+		"INSERT INTO %s (%s) SELECT %s FROM %s%s ON CONFLICT (%s) %s",
+		mapping.DestTable,
+		strings.Join(cols, ", "),
+		strings.Join(cols, ", "),
+		castedSource,
+		where,
+		strings.Join(mapping.PrimaryKey, ", "),
+		conflictAction,
+	)
+}
+
+// sqlQuerier is satisfied by both pgx.Tx and pgxpool.Pool. destColumnTypes
+// runs against a live transaction while applying changes, and directly
+// against the pool when only building the dry-run SQL preview.
+type sqlQuerier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// destColumnTypes looks up the Postgres type of every column on table, so
+// applyUpsertBatch can cast the text-staged values back to their real
+// types in the merge query.
+func destColumnTypes(ctx context.Context, q sqlQuerier, table string) (map[string]string, error) {
+	rows, err := q.Query(ctx, `
+		SELECT a.attname, format_type(a.atttypid, a.atttypmod)
+		FROM pg_attribute a
+		JOIN pg_class c ON a.attrelid = c.oid
+		WHERE c.relname = $1 AND a.attnum > 0 AND NOT a.attisdropped
+	`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := make(map[string]string)
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return nil, err
+		}
+		types[name] = typ
+	}
+	return types, rows.Err()
+}
+
+// applyDeleteBatch removes every staged row in one statement when the
+// table has a single-column primary key; composite keys fall back to one
+// statement per row, still inside the same transaction.
+func applyDeleteBatch(ctx context.Context, tx pgx.Tx, mapping *TableMapping, deleteKeys [][]string) error {
+	if len(mapping.PrimaryKey) != 1 {
+		for _, key := range deleteKeys {
+			conds := make([]string, len(mapping.PrimaryKey))
+			args := make([]any, len(mapping.PrimaryKey))
+			for i, pk := range mapping.PrimaryKey {
+				conds[i] = fmt.Sprintf("%s = $%d", pk, i+1)
+				args[i] = key[i]
+			}
+			query := fmt.Sprintf("DELETE FROM %s WHERE %s", mapping.DestTable, strings.Join(conds, " AND "))
+			if _, err := tx.Exec(ctx, query, args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	pk := mapping.PrimaryKey[0]
+	keys := make([]string, len(deleteKeys))
+	for i, key := range deleteKeys {
+		keys[i] = key[0]
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s = ANY($1)", mapping.DestTable, pk)
+	_, err := tx.Exec(ctx, query, keys)
+	return err
+}
+
+// logDryRunBatch logs the statements flushBatch would execute for a
+// table's staged changes, built the same way applyUpsertBatch and
+// applyDeleteBatch do, without sending anything but the read-only column
+// type lookup to the secondary. The upsert preview assumes every column is
+// present (the common case); a transaction carrying TOASTed-and-unchanged
+// columns will actually run one merge per distinct shape, per applyUpsertBatch.
+func (r *Replicator) logDryRunBatch(ctx context.Context, b *tableBatch) {
+	var upsertCount, deleteCount int
+	for _, op := range b.ops {
+		switch op.kind {
+		case opUpsert:
+			upsertCount++
+		case opDelete:
+			deleteCount++
+		}
+	}
+
+	if upsertCount > 0 {
+		destCols := make([]string, len(b.mapping.Columns))
+		for i, c := range b.mapping.Columns {
+			destCols[i] = c.destName()
+		}
+
+		colTypes, err := destColumnTypes(ctx, r.secondaryDB, b.mapping.DestTable)
+		if err != nil {
+			logger.Warn("dry-run: failed to look up column types, skipping upsert preview",
+				"table", b.mapping.DestTable, "error", err)
+		} else {
+			query := upsertMergeQuery(b.mapping, destCols, colTypes, "stage_"+b.mapping.DestTable)
+			logger.Info("dry-run bulk upsert",
+				"table", b.mapping.DestTable, "row_count", upsertCount,
+				"batch_size", b.mapping.BatchSize, "sql", query)
+		}
+	}
+
+	if deleteCount > 0 {
+		logger.Info("dry-run bulk delete",
+			"table", b.mapping.DestTable, "row_count", deleteCount,
+			"sql", deleteQuery(b.mapping))
+	}
+}
+
+// deleteQuery returns the statement applyDeleteBatch would run to delete a
+// batch of rows for mapping - parameterized, since the actual key values
+// only matter once the query is sent.
+func deleteQuery(mapping *TableMapping) string {
+	if len(mapping.PrimaryKey) != 1 {
+		conds := make([]string, len(mapping.PrimaryKey))
+		for i, pk := range mapping.PrimaryKey {
+			conds[i] = fmt.Sprintf("%s = $%d", pk, i+1)
+		}
+		return fmt.Sprintf("DELETE FROM %s WHERE %s (one statement per deleted row)", mapping.DestTable, strings.Join(conds, " AND "))
+	}
+	return fmt.Sprintf("DELETE FROM %s WHERE %s = ANY($1)", mapping.DestTable, mapping.PrimaryKey[0])
+}
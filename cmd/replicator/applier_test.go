@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func strPtr(s string) *string { return &s }
+
+func usersMapping() *TableMapping {
+	return &TableMapping{
+		SourceTable: "users",
+		DestTable:   "users",
+		PrimaryKey:  []string{"user_id"},
+		Columns: []ColumnMapping{
+			{Source: "user_id"},
+			{Source: "name"},
+			{Source: "email"},
+		},
+		BatchSize: 2,
+	}
+}
+
+func TestChunkUpsertsSplitsBySize(t *testing.T) {
+	rows := make([]map[string]*string, 5)
+	for i := range rows {
+		rows[i] = map[string]*string{"user_id": strPtr(strconv.Itoa(i))}
+	}
+
+	chunks := chunkUpserts(rows, 2)
+	if len(chunks) != 3 {
+		t.Fatalf("got %d chunks, want 3", len(chunks))
+	}
+	if len(chunks[0]) != 2 || len(chunks[1]) != 2 || len(chunks[2]) != 1 {
+		t.Fatalf("unexpected chunk sizes: %v", chunkLens(chunks))
+	}
+}
+
+func TestChunkUpsertsNoLimitWhenSizeNonPositive(t *testing.T) {
+	rows := make([]map[string]*string, 3)
+	chunks := chunkUpserts(rows, 0)
+	if len(chunks) != 1 || len(chunks[0]) != 3 {
+		t.Fatalf("expected a single chunk of 3, got %v", chunkLens(chunks))
+	}
+}
+
+func TestChunkUpsertsSingleChunkWhenSizeExceedsRows(t *testing.T) {
+	rows := make([]map[string]*string, 3)
+	chunks := chunkUpserts(rows, 100)
+	if len(chunks) != 1 || len(chunks[0]) != 3 {
+		t.Fatalf("expected a single chunk of 3, got %v", chunkLens(chunks))
+	}
+}
+
+func chunkLens(chunks [][]map[string]*string) []int {
+	lens := make([]int, len(chunks))
+	for i, c := range chunks {
+		lens[i] = len(c)
+	}
+	return lens
+}
+
+func TestSplitRunsKeepsDistinctKeysInOneRun(t *testing.T) {
+	ops := []rowOp{
+		{kind: opUpsert, key: []string{"1"}},
+		{kind: opUpsert, key: []string{"2"}},
+		{kind: opDelete, key: []string{"3"}},
+	}
+	runs := splitRuns(ops)
+	if len(runs) != 1 || len(runs[0]) != 3 {
+		t.Fatalf("expected all distinct keys in a single run, got %d runs", len(runs))
+	}
+}
+
+func TestSplitRunsBreaksOnRepeatedKey(t *testing.T) {
+	ops := []rowOp{
+		{kind: opUpsert, key: []string{"1"}},
+		{kind: opDelete, key: []string{"1"}},
+		{kind: opUpsert, key: []string{"1"}},
+	}
+	runs := splitRuns(ops)
+	if len(runs) != 3 {
+		t.Fatalf("expected one run per op since key 1 repeats every time, got %d", len(runs))
+	}
+	for i, run := range runs {
+		if len(run) != 1 {
+			t.Fatalf("run %d: got %d ops, want 1", i, len(run))
+		}
+	}
+}
+
+func TestGroupByShapeSeparatesRowsMissingAColumn(t *testing.T) {
+	mapping := usersMapping()
+	full := map[string]*string{"user_id": strPtr("1"), "name": strPtr("alice"), "email": strPtr("a@example.com")}
+	missingEmail := map[string]*string{"user_id": strPtr("2"), "name": strPtr("bob")}
+
+	shapes := groupByShape(mapping, []map[string]*string{full, missingEmail})
+	if len(shapes) != 2 {
+		t.Fatalf("got %d shapes, want 2", len(shapes))
+	}
+	for _, s := range shapes {
+		if len(s.rows) != 1 {
+			t.Fatalf("expected each shape to hold exactly its one row, got %d", len(s.rows))
+		}
+	}
+}
+
+func TestGroupByShapeKeepsSameShapeRowsTogether(t *testing.T) {
+	mapping := usersMapping()
+	rows := []map[string]*string{
+		{"user_id": strPtr("1"), "name": strPtr("alice"), "email": strPtr("a@example.com")},
+		{"user_id": strPtr("2"), "name": strPtr("bob"), "email": strPtr("b@example.com")},
+	}
+	shapes := groupByShape(mapping, rows)
+	if len(shapes) != 1 {
+		t.Fatalf("got %d shapes, want 1", len(shapes))
+	}
+	if len(shapes[0].rows) != 2 {
+		t.Fatalf("got %d rows in the shared shape, want 2", len(shapes[0].rows))
+	}
+}
+
+func TestUpsertMergeQueryCastsAndAppliesFilter(t *testing.T) {
+	mapping := usersMapping()
+	mapping.Filter = "age > 18"
+	colTypes := map[string]string{"user_id": "integer", "name": "text", "email": "text"}
+
+	query := upsertMergeQuery(mapping, []string{"user_id", "name", "email"}, colTypes, "stage_users_0_0")
+
+	if !strings.Contains(query, "user_id::integer AS user_id") {
+		t.Fatalf("query does not cast user_id to its destination type: %s", query)
+	}
+	if !strings.Contains(query, "WHERE age > 18") {
+		t.Fatalf("query does not apply the configured filter: %s", query)
+	}
+	if !strings.Contains(query, "ON CONFLICT (user_id) DO UPDATE SET name = EXCLUDED.name, email = EXCLUDED.email") {
+		t.Fatalf("query does not merge non-key columns on conflict: %s", query)
+	}
+}
+
+func TestUpsertMergeQueryOmitsWhereWithoutFilter(t *testing.T) {
+	mapping := usersMapping()
+	colTypes := map[string]string{"user_id": "integer", "name": "text", "email": "text"}
+
+	query := upsertMergeQuery(mapping, []string{"user_id", "name", "email"}, colTypes, "stage_users_0_0")
+	if strings.Contains(query, "WHERE") {
+		t.Fatalf("query should have no WHERE clause without a configured filter: %s", query)
+	}
+}
+
+func TestUpsertMergeQueryPrimaryKeyOnlyDoesNothingOnConflict(t *testing.T) {
+	mapping := &TableMapping{
+		SourceTable: "tags",
+		DestTable:   "tags",
+		PrimaryKey:  []string{"tag_id"},
+		Columns:     []ColumnMapping{{Source: "tag_id"}},
+	}
+	colTypes := map[string]string{"tag_id": "integer"}
+
+	query := upsertMergeQuery(mapping, []string{"tag_id"}, colTypes, "stage_tags_0_0")
+	if !strings.Contains(query, "DO NOTHING") {
+		t.Fatalf("expected DO NOTHING when every column is the primary key: %s", query)
+	}
+}
+
+func TestDeleteQuerySingleColumnKey(t *testing.T) {
+	mapping := usersMapping()
+	query := deleteQuery(mapping)
+	want := "DELETE FROM users WHERE user_id = ANY($1)"
+	if query != want {
+		t.Fatalf("got %q, want %q", query, want)
+	}
+}
+
+func TestDeleteQueryCompositeKey(t *testing.T) {
+	mapping := &TableMapping{
+		DestTable:  "memberships",
+		PrimaryKey: []string{"org_id", "user_id"},
+	}
+	query := deleteQuery(mapping)
+	if !strings.Contains(query, "org_id = $1 AND user_id = $2") {
+		t.Fatalf("expected composite key condition, got %q", query)
+	}
+}
+
+// BenchmarkStageAndGroup exercises the in-process staging and grouping
+// path - rowKey, splitRuns and groupByShape - against a transaction-sized
+// batch of upserts, to demonstrate the pure batching logic comfortably
+// clears the >10k changes/s target this replicator is built to sustain.
+// It does not cover the SQL round trip, which depends on the secondary
+// database's own throughput.
+func BenchmarkStageAndGroup(b *testing.B) {
+	mapping := usersMapping()
+	const rowCount = 5000
+
+	rows := make([]map[string]*string, rowCount)
+	for i := range rows {
+		rows[i] = map[string]*string{
+			"user_id": strPtr(strconv.Itoa(i)),
+			"name":    strPtr(fmt.Sprintf("user-%d", i)),
+			"email":   strPtr(fmt.Sprintf("user-%d@example.com", i)),
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bs := newBatchSet()
+		for _, row := range rows {
+			if err := stageUpsert(bs, mapping, row); err != nil {
+				b.Fatalf("stageUpsert: %v", err)
+			}
+		}
+		tb := bs.tables[mapping.SourceTable]
+		for _, run := range splitRuns(tb.ops) {
+			var upserts []map[string]*string
+			for _, op := range run {
+				upserts = append(upserts, op.values)
+			}
+			groupByShape(mapping, upserts)
+		}
+	}
+	b.ReportMetric(float64(rowCount)*float64(b.N)/b.Elapsed().Seconds(), "changes/s")
+}
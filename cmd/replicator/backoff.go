@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func newBackOff() *backoff.ExponentialBackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = 500 * time.Millisecond
+	b.MaxInterval = 30 * time.Second
+	b.MaxElapsedTime = 0 // retry forever; callers rely on ctx cancellation to stop
+	return b
+}
+
+// connectPoolWithBackoff connects and pings a pool, retrying with
+// exponential backoff and jitter until it succeeds or ctx is cancelled.
+// It's used for the initial primary/secondary connections so a database
+// that isn't up yet doesn't make the whole process fail fast.
+func connectPoolWithBackoff(ctx context.Context, name, connStr string) (*pgxpool.Pool, error) {
+	b := newBackOff()
+
+	for {
+		pool, err := pgxpool.New(ctx, connStr)
+		if err == nil {
+			if err = pool.Ping(ctx); err == nil {
+				return pool, nil
+			}
+			pool.Close()
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		wait := b.NextBackOff()
+		logger.Warn("database connect failed, retrying", "database", name, "retry_in", wait, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// reconnectLoop repeatedly invokes attempt, applying exponential backoff
+// with jitter between failures and pausing so a downed primary isn't
+// hammered. attempt reports whether it got far enough to be considered a
+// healthy connection even if it later errored out (e.g. the stream broke
+// after replicating for hours) - a healthy attempt resets the backoff so
+// the next failure doesn't inherit a stale, maxed-out interval. It returns
+// only once ctx is cancelled.
+func (r *Replicator) reconnectLoop(ctx context.Context, attempt func(ctx context.Context) (healthy bool, err error)) {
+	b := newBackOff()
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		healthy, err := attempt(ctx)
+		if healthy {
+			b.Reset()
+			r.resetBackoffStatus()
+		}
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		wait := b.NextBackOff()
+		r.statusMu.Lock()
+		r.status.ConsecutiveFailures++
+		nextRetry := time.Now().Add(wait)
+		r.status.NextRetryAt = &nextRetry
+		failures := r.status.ConsecutiveFailures
+		r.statusMu.Unlock()
+		logger.Warn("reconnect attempt failed, retrying", "attempt", failures, "retry_in", wait, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (r *Replicator) resetBackoffStatus() {
+	r.statusMu.Lock()
+	r.status.ConsecutiveFailures = 0
+	r.status.NextRetryAt = nil
+	r.statusMu.Unlock()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ColumnMapping describes how a single column is carried from the
+// published source table into the destination table. Dest defaults to
+// Source when omitted, so a same-named column only needs to list Source.
+type ColumnMapping struct {
+	Source string `yaml:"source"`
+	Dest   string `yaml:"dest,omitempty"`
+}
+
+func (c ColumnMapping) destName() string {
+	if c.Dest != "" {
+		return c.Dest
+	}
+	return c.Source
+}
+
+// TableMapping declares one source-to-destination replication pipeline:
+// which published table to read, which table and columns to write, the
+// columns that form its primary key, an optional row filter, and the
+// batch size to apply changes in.
+type TableMapping struct {
+	SourceTable string          `yaml:"source_table"`
+	DestTable   string          `yaml:"dest_table"`
+	PrimaryKey  []string        `yaml:"primary_key"`
+	Columns     []ColumnMapping `yaml:"columns"`
+	Filter      string          `yaml:"filter,omitempty"`
+	BatchSize   int             `yaml:"batch_size,omitempty"`
+}
+
+func (t TableMapping) isPrimaryKey(destCol string) bool {
+	for _, pk := range t.PrimaryKey {
+		if pk == destCol {
+			return true
+		}
+	}
+	return false
+}
+
+// ReplicationConfig is the top-level shape of the --config YAML file: a
+// declarative list of tables to replicate from the publication onto the
+// secondary database.
+type ReplicationConfig struct {
+	Tables []TableMapping `yaml:"tables"`
+}
+
+// defaultReplicationConfig mirrors the tool's original single hard-coded
+// users pipeline, used when no --config flag is given.
+func defaultReplicationConfig() *ReplicationConfig {
+	return &ReplicationConfig{
+		Tables: []TableMapping{
+			{
+				SourceTable: "users",
+				DestTable:   "users",
+				PrimaryKey:  []string{"user_id"},
+				Columns: []ColumnMapping{
+					{Source: "user_id"},
+					{Source: "name"},
+					{Source: "email"},
+					{Source: "created_at"},
+					{Source: "updated_at"},
+				},
+				BatchSize: 100,
+			},
+		},
+	}
+}
+
+// loadReplicationConfig reads and validates the YAML file at path,
+// falling back to defaultReplicationConfig when path is empty.
+func loadReplicationConfig(path string) (*ReplicationConfig, error) {
+	if path == "" {
+		return defaultReplicationConfig(), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config %q: %w", path, err)
+	}
+
+	var cfg ReplicationConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse config %q: %w", path, err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %q: %w", path, err)
+	}
+
+	return &cfg, nil
+}
+
+// Validate checks that every mapping has enough information to build SQL
+// from, failing fast at startup rather than at the first replicated row.
+func (c *ReplicationConfig) Validate() error {
+	if len(c.Tables) == 0 {
+		return fmt.Errorf("no tables configured")
+	}
+
+	seen := make(map[string]bool, len(c.Tables))
+	for i, t := range c.Tables {
+		if t.SourceTable == "" {
+			return fmt.Errorf("tables[%d]: source_table is required", i)
+		}
+		if seen[t.SourceTable] {
+			return fmt.Errorf("tables[%d]: duplicate source_table %q", i, t.SourceTable)
+		}
+		seen[t.SourceTable] = true
+
+		if t.DestTable == "" {
+			return fmt.Errorf("tables[%d] (%s): dest_table is required", i, t.SourceTable)
+		}
+		if len(t.PrimaryKey) == 0 {
+			return fmt.Errorf("tables[%d] (%s): primary_key is required", i, t.SourceTable)
+		}
+		if len(t.Columns) == 0 {
+			return fmt.Errorf("tables[%d] (%s): columns is required", i, t.SourceTable)
+		}
+
+		destCols := make(map[string]bool, len(t.Columns))
+		for _, col := range t.Columns {
+			if col.Source == "" {
+				return fmt.Errorf("tables[%d] (%s): column with empty source", i, t.SourceTable)
+			}
+			destCols[col.destName()] = true
+		}
+		for _, pk := range t.PrimaryKey {
+			if !destCols[pk] {
+				return fmt.Errorf("tables[%d] (%s): primary_key column %q is not in columns", i, t.SourceTable, pk)
+			}
+		}
+	}
+
+	return nil
+}
+
+// byTable indexes a config's tables by source table name for O(1) lookup
+// while decoding WAL messages.
+func (c *ReplicationConfig) byTable() map[string]*TableMapping {
+	m := make(map[string]*TableMapping, len(c.Tables))
+	for i := range c.Tables {
+		m[c.Tables[i].SourceTable] = &c.Tables[i]
+	}
+	return m
+}
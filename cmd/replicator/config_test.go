@@ -0,0 +1,84 @@
+package main
+
+import "testing"
+
+func validMapping() TableMapping {
+	return TableMapping{
+		SourceTable: "users",
+		DestTable:   "users",
+		PrimaryKey:  []string{"user_id"},
+		Columns: []ColumnMapping{
+			{Source: "user_id"},
+			{Source: "name"},
+		},
+	}
+}
+
+func TestValidateAcceptsDefaultConfig(t *testing.T) {
+	if err := defaultReplicationConfig().Validate(); err != nil {
+		t.Fatalf("default config should be valid, got: %v", err)
+	}
+}
+
+func TestValidateRejectsNoTables(t *testing.T) {
+	cfg := &ReplicationConfig{}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error for empty table list")
+	}
+}
+
+func TestValidateRejectsDuplicateSourceTable(t *testing.T) {
+	m := validMapping()
+	cfg := &ReplicationConfig{Tables: []TableMapping{m, m}}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error for duplicate source_table")
+	}
+}
+
+func TestValidateRejectsMissingDestTable(t *testing.T) {
+	m := validMapping()
+	m.DestTable = ""
+	cfg := &ReplicationConfig{Tables: []TableMapping{m}}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error for missing dest_table")
+	}
+}
+
+func TestValidateRejectsMissingPrimaryKey(t *testing.T) {
+	m := validMapping()
+	m.PrimaryKey = nil
+	cfg := &ReplicationConfig{Tables: []TableMapping{m}}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error for missing primary_key")
+	}
+}
+
+func TestValidateRejectsPrimaryKeyNotInColumns(t *testing.T) {
+	m := validMapping()
+	m.PrimaryKey = []string{"does_not_exist"}
+	cfg := &ReplicationConfig{Tables: []TableMapping{m}}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error for primary_key column not present in columns")
+	}
+}
+
+func TestValidateRejectsColumnWithEmptySource(t *testing.T) {
+	m := validMapping()
+	m.Columns = append(m.Columns, ColumnMapping{})
+	cfg := &ReplicationConfig{Tables: []TableMapping{m}}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error for column with empty source")
+	}
+}
+
+func TestColumnMappingDestNameFallsBackToSource(t *testing.T) {
+	c := ColumnMapping{Source: "user_id"}
+	if got := c.destName(); got != "user_id" {
+		t.Fatalf("destName() = %q, want %q", got, "user_id")
+	}
+
+	c = ColumnMapping{Source: "user_id", Dest: "id"}
+	if got := c.destName(); got != "id" {
+		t.Fatalf("destName() = %q, want %q", got, "id")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ensureLeaderTable creates the bookkeeping table instances use to
+// publish who currently holds the leader advisory lock, so /leader can
+// answer the question on any instance, not just the leader.
+func (r *Replicator) ensureLeaderTable(ctx context.Context) error {
+	_, err := r.primaryDB.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS replicator_leader (
+			lock_key     BIGINT PRIMARY KEY,
+			instance_id  TEXT NOT NULL,
+			leader_since TIMESTAMPTZ NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("ensure leader table: %w", err)
+	}
+	return nil
+}
+
+// runWithLeaderElection blocks until ctx is cancelled. It repeatedly tries
+// to take the configured PostgreSQL advisory lock on the primary; only
+// the instance holding the lock runs fn. Every other instance stays a
+// follower, reporting role "follower" on /status, and retries once per
+// PollInterval - so a lock released by a departing leader is picked up
+// within one poll interval.
+func (r *Replicator) runWithLeaderElection(ctx context.Context, fn func(ctx context.Context)) {
+	ticker := time.NewTicker(r.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		conn, acquired, err := r.tryAcquireLeaderLock(ctx)
+		if err != nil {
+			logger.Warn("leader election attempt failed", "error", err)
+		} else if acquired {
+			r.leadUntilLockLost(ctx, conn, fn)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// leadUntilLockLost runs fn for as long as this instance still holds the
+// advisory lock on conn, re-checking it every PollInterval. The lock is a
+// session-level lock tied to conn's underlying connection: if that
+// connection drops - a network blip, the pool recycling it - Postgres
+// releases the lock without telling us, and a follower can acquire it on
+// its next tick while we keep running fn, producing two active leaders.
+// Pinging conn on a schedule catches that the moment it happens and
+// cancels fn's context instead of trusting the lock for fn's whole
+// lifetime.
+func (r *Replicator) leadUntilLockLost(ctx context.Context, conn *pgxpool.Conn, fn func(ctx context.Context)) {
+	r.becomeLeader(ctx)
+	defer r.becomeFollower()
+	defer r.releaseLeaderLock(conn)
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		fn(leaderCtx)
+		close(done)
+	}()
+
+	ticker := time.NewTicker(r.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !r.leaderLockHeld(ctx, conn) {
+				logger.Warn("lost leader advisory lock, stepping down", "instance_id", r.instanceID)
+				cancel()
+				<-done
+				return
+			}
+		}
+	}
+}
+
+// leaderLockHeld checks that conn's underlying connection is still alive,
+// which is the only way to notice a session-level advisory lock being
+// dropped out from under us - Postgres doesn't otherwise signal it.
+func (r *Replicator) leaderLockHeld(ctx context.Context, conn *pgxpool.Conn) bool {
+	var one int
+	return conn.QueryRow(ctx, "SELECT 1").Scan(&one) == nil
+}
+
+func (r *Replicator) tryAcquireLeaderLock(ctx context.Context) (*pgxpool.Conn, bool, error) {
+	conn, err := r.primaryDB.Acquire(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("acquire connection for leader lock: %w", err)
+	}
+
+	var acquired bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", r.config.LeaderLockKey).Scan(&acquired); err != nil {
+		conn.Release()
+		return nil, false, fmt.Errorf("pg_try_advisory_lock: %w", err)
+	}
+	if !acquired {
+		conn.Release()
+		return nil, false, nil
+	}
+	return conn, true, nil
+}
+
+// releaseLeaderLock unlocks the advisory lock and returns the dedicated
+// connection to the pool. It's called both on graceful shutdown and
+// whenever fn returns (e.g. because ctx was cancelled).
+func (r *Replicator) releaseLeaderLock(conn *pgxpool.Conn) {
+	if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", r.config.LeaderLockKey); err != nil {
+		logger.Warn("failed to release leader advisory lock", "error", err)
+	}
+	conn.Release()
+}
+
+func (r *Replicator) becomeLeader(ctx context.Context) {
+	now := time.Now()
+
+	r.statusMu.Lock()
+	r.status.Role = "leader"
+	r.status.LeaderSince = &now
+	r.statusMu.Unlock()
+
+	_, err := r.primaryDB.Exec(ctx, `
+		INSERT INTO replicator_leader (lock_key, instance_id, leader_since)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (lock_key) DO UPDATE SET
+			instance_id  = EXCLUDED.instance_id,
+			leader_since = EXCLUDED.leader_since
+	`, r.config.LeaderLockKey, r.instanceID, now)
+	if err != nil {
+		logger.Warn("failed to publish leader identity", "error", err)
+	}
+
+	logger.Info("became leader", "instance_id", r.instanceID)
+}
+
+func (r *Replicator) becomeFollower() {
+	r.statusMu.Lock()
+	r.status.Role = "follower"
+	r.status.LeaderSince = nil
+	r.statusMu.Unlock()
+
+	logger.Info("stepped down from leader", "instance_id", r.instanceID)
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// logger is the process-wide structured logger. It's used both by
+// Replicator methods and by the package-level helpers (connectPoolWithBackoff,
+// main) that run before a Replicator exists.
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
@@ -3,15 +3,17 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
@@ -21,21 +23,33 @@ type Config struct {
 	PrimaryConnStr   string
 	SecondaryConnStr string
 	PollInterval     time.Duration
+	SlotName         string
+	PublicationName  string
+	Replication      *ReplicationConfig
+	DryRun           bool
+	LeaderLockKey    int64
 }
 
 type ReplicationStatus struct {
-	LastLSN        string    `json:"last_lsn"`
-	LastSyncTime   time.Time `json:"last_sync_time"`
-	RecordsReplied int64     `json:"records_replicated"`
-	ErrorCount     int64     `json:"error_count"`
-	LastError      string    `json:"last_error,omitempty"`
-	IsRunning      bool      `json:"is_running"`
+	LastLSN             string     `json:"last_lsn"`
+	LastSyncTime        time.Time  `json:"last_sync_time"`
+	RecordsReplied      int64      `json:"records_replicated"`
+	ErrorCount          int64      `json:"error_count"`
+	LastError           string     `json:"last_error,omitempty"`
+	IsRunning           bool       `json:"is_running"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	NextRetryAt         *time.Time `json:"next_retry_at,omitempty"`
+	Role                string     `json:"role"`
+	LeaderSince         *time.Time `json:"leader_since,omitempty"`
 }
 
 type Replicator struct {
 	primaryDB   *pgxpool.Pool
 	secondaryDB *pgxpool.Pool
 	config      Config
+	mappings    map[string]*TableMapping
+	dryRun      bool
+	instanceID  string
 	status      ReplicationStatus
 	statusMu    sync.RWMutex
 	ctx         context.Context
@@ -43,9 +57,14 @@ type Replicator struct {
 }
 
 func main() {
+	configPath := flag.String("config", "", "path to a YAML file declaring replication table mappings")
+	dryRun := flag.Bool("dry-run", false, "print generated SQL statements instead of executing them")
+	flag.Parse()
+
 	err := godotenv.Load("D:\\Code\\Go-Web-Template\\.env")
 	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+		logger.Error("failed to load .env file", "error", err)
+		os.Exit(1)
 	}
 
 	main_database_host := os.Getenv("DATABASE_URL_HOST")
@@ -60,17 +79,29 @@ func main() {
 	replicator_database_password := os.Getenv("DATABASE_URL_REPLICATOR_PASSWORD")
 	replicator_database_dbname := os.Getenv("DATABASE_URL_REPLICATOR_DBNAME")
 
+	replicationConfig, err := loadReplicationConfig(*configPath)
+	if err != nil {
+		logger.Error("failed to load replication config", "error", err)
+		os.Exit(1)
+	}
+
 	config := Config{
 		PrimaryConnStr: fmt.Sprintf("host=%s port=%d user=%s "+
 			"password=%s dbname=%s sslmode=require default_query_exec_mode=simple_protocol", main_database_host, main_database_port, main_database_user, main_database_password, main_database_dbname),
 		SecondaryConnStr: fmt.Sprintf("host=%s port=%d user=%s "+
 			"password=%s dbname=%s sslmode=require default_query_exec_mode=simple_protocol", replicator_database_host, replicator_database_port, replicator_database_user, replicator_database_password, replicator_database_dbname),
-		PollInterval: 5 * time.Second,
+		PollInterval:    5 * time.Second,
+		SlotName:        envOrDefault("REPLICATION_SLOT_NAME", "go_web_template_slot"),
+		PublicationName: envOrDefault("REPLICATION_PUBLICATION_NAME", "go_web_template_pub"),
+		Replication:     replicationConfig,
+		DryRun:          *dryRun,
+		LeaderLockKey:   leaderLockKey(),
 	}
 
 	replicator, err := NewReplicator(config)
 	if err != nil {
-		log.Fatalf("Failed to create replicator: %v", err)
+		logger.Error("failed to create replicator", "error", err)
+		os.Exit(1)
 	}
 	defer replicator.Close()
 
@@ -81,6 +112,8 @@ func main() {
 	router := mux.NewRouter()
 	router.HandleFunc("/status", replicator.HandleStatus).Methods("GET")
 	router.HandleFunc("/health", replicator.HandleHealth).Methods("GET")
+	router.HandleFunc("/metrics", replicator.HandleMetrics).Methods("GET")
+	router.HandleFunc("/leader", replicator.HandleLeader).Methods("GET")
 
 	srv := &http.Server{
 		Addr:    ":8080",
@@ -88,9 +121,10 @@ func main() {
 	}
 
 	go func() {
-		log.Println("Starting HTTP server on :8080")
+		logger.Info("starting http server", "addr", srv.Addr)
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("HTTP server error: %v", err)
+			logger.Error("http server error", "error", err)
+			os.Exit(1)
 		}
 	}()
 
@@ -99,56 +133,79 @@ func main() {
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	<-sigChan
 
-	log.Println("Shutting down...")
+	logger.Info("shutting down")
 	replicator.Stop()
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	srv.Shutdown(ctx)
 }
 
+func envOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// defaultLeaderLockKey is an arbitrary but fixed advisory lock key so
+// every instance of this tool agrees on which lock guards leadership,
+// without needing a shared config file.
+const defaultLeaderLockKey = 727001
+
+func leaderLockKey() int64 {
+	v := os.Getenv("REPLICATION_LEADER_LOCK_KEY")
+	if v == "" {
+		return defaultLeaderLockKey
+	}
+	key, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		logger.Warn("invalid REPLICATION_LEADER_LOCK_KEY, using default", "value", v, "error", err)
+		return defaultLeaderLockKey
+	}
+	return key
+}
+
 func NewReplicator(config Config) (*Replicator, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	primaryDB, err := pgxpool.New(context.Background(), config.PrimaryConnStr)
+	primaryDB, err := connectPoolWithBackoff(ctx, "primary", config.PrimaryConnStr)
 	if err != nil {
 		cancel()
 		return nil, fmt.Errorf("failed to connect to primary: %w", err)
 	}
 
-	secondaryDB, err := pgxpool.New(context.Background(), config.SecondaryConnStr)
+	secondaryDB, err := connectPoolWithBackoff(ctx, "secondary", config.SecondaryConnStr)
 	if err != nil {
 		primaryDB.Close()
 		cancel()
 		return nil, fmt.Errorf("failed to connect to secondary: %w", err)
 	}
 
-	// Test connections
-	if err := primaryDB.Ping(context.Background()); err != nil {
-		primaryDB.Close()
-		secondaryDB.Close()
-		cancel()
-		return nil, fmt.Errorf("primary DB ping failed: %w", err)
-	}
-
-	if err := secondaryDB.Ping(context.Background()); err != nil {
-		primaryDB.Close()
-		secondaryDB.Close()
-		cancel()
-		return nil, fmt.Errorf("secondary DB ping failed: %w", err)
-	}
-
-	log.Println("Connected to primary and secondary databases")
+	logger.Info("connected to primary and secondary databases")
 
-	return &Replicator{
+	r := &Replicator{
 		primaryDB:   primaryDB,
 		secondaryDB: secondaryDB,
 		config:      config,
+		mappings:    config.Replication.byTable(),
+		dryRun:      config.DryRun,
+		instanceID:  uuid.NewString(),
 		ctx:         ctx,
 		cancel:      cancel,
 		status: ReplicationStatus{
 			IsRunning: false,
+			Role:      "follower",
 		},
-	}, nil
+	}
+
+	if err := r.ensureLeaderTable(ctx); err != nil {
+		primaryDB.Close()
+		secondaryDB.Close()
+		cancel()
+		return nil, err
+	}
+
+	return r, nil
 }
 
 func (r *Replicator) Start() {
@@ -156,25 +213,36 @@ func (r *Replicator) Start() {
 	r.status.IsRunning = true
 	r.statusMu.Unlock()
 
-	log.Println("Replication started")
-	ticker := time.NewTicker(r.config.PollInterval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-r.ctx.Done():
-			log.Println("Replication stopped")
-			return
-		case <-ticker.C:
-			if err := r.pollAndReplicate(); err != nil {
-				log.Printf("Replication error: %v", err)
+	logger.Info("replication started", "instance_id", r.instanceID)
+	metricUp.Set(0)
+
+	r.runWithLeaderElection(r.ctx, func(ctx context.Context) {
+		r.reconnectLoop(ctx, func(ctx context.Context) (bool, error) {
+			rc, err := r.connectReplication(ctx)
+			if err != nil {
+				metricErrors.WithLabelValues("connect").Inc()
 				r.statusMu.Lock()
 				r.status.ErrorCount++
 				r.status.LastError = err.Error()
 				r.statusMu.Unlock()
+				return false, err
 			}
-		}
-	}
+
+			metricUp.Set(1)
+			err = r.streamReplication(ctx, rc)
+			metricUp.Set(0)
+			if err != nil && ctx.Err() == nil {
+				metricErrors.WithLabelValues("stream").Inc()
+				r.statusMu.Lock()
+				r.status.ErrorCount++
+				r.status.LastError = err.Error()
+				r.statusMu.Unlock()
+			}
+			return true, err
+		})
+	})
+
+	logger.Info("replication stopped")
 }
 
 func (r *Replicator) Stop() {
@@ -193,112 +261,6 @@ func (r *Replicator) Close() {
 	}
 }
 
-func (r *Replicator) pollAndReplicate() error {
-	// Query unprocessed changes from user_changes table
-	query := `
-		SELECT 
-			change_id,
-			operation,
-			user_id,
-			name,
-			email,
-			created_at,
-			updated_at
-		FROM user_changes
-		WHERE processed = false
-		ORDER BY change_id
-		LIMIT 100
-	`
-
-	rows, err := r.primaryDB.Query(context.Background(), query)
-	if err != nil {
-		return fmt.Errorf("change query failed: %w", err)
-	}
-	defer rows.Close()
-
-	changeCount := 0
-	var lastChangeID int64
-	processedIDs := []int64{}
-
-	for rows.Next() {
-		var changeID int64
-		var operation string
-		var userId *int32
-		var name, email *string
-		var createdAt, updatedAt *time.Time
-
-		if err := rows.Scan(&changeID, &operation, &userId, &name, &email, &createdAt, &updatedAt); err != nil {
-			return fmt.Errorf("scan error: %w", err)
-		}
-
-		lastChangeID = changeID
-
-		// Apply the change to secondary database
-		switch operation {
-		case "INSERT", "UPDATE":
-			if userId != nil && name != nil {
-				if err := r.upsertRecord(*userId, *name, email, createdAt, updatedAt); err != nil {
-					return fmt.Errorf("upsert failed: %w", err)
-				}
-				processedIDs = append(processedIDs, changeID)
-				changeCount++
-			}
-		case "DELETE":
-			if userId != nil {
-				if err := r.deleteRecord(*userId); err != nil {
-					return fmt.Errorf("delete failed: %w", err)
-				}
-				processedIDs = append(processedIDs, changeID)
-				changeCount++
-			}
-		}
-	}
-
-	if err := rows.Err(); err != nil {
-		return err
-	}
-
-	// Mark changes as processed
-	if len(processedIDs) > 0 {
-		updateQuery := `UPDATE user_changes SET processed = true WHERE change_id = ANY($1)`
-		_, err := r.primaryDB.Exec(context.Background(), updateQuery, processedIDs)
-		if err != nil {
-			return fmt.Errorf("failed to mark changes as processed: %w", err)
-		}
-	}
-
-	if changeCount > 0 {
-		r.statusMu.Lock()
-		r.status.RecordsReplied += int64(changeCount)
-		r.status.LastSyncTime = time.Now()
-		r.status.LastLSN = fmt.Sprintf("%d", lastChangeID)
-		r.status.LastError = ""
-		r.statusMu.Unlock()
-		log.Printf("Replicated %d changes (up to change_id %d)", changeCount, lastChangeID)
-	}
-
-	return nil
-}
-
-func (r *Replicator) upsertRecord(userId int32, name string, email *string, createdAt, updatedAt *time.Time) error {
-	query := `
-		INSERT INTO users (user_id, name, email, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5)
-		ON CONFLICT (user_id) 
-		DO UPDATE SET 
-			name = EXCLUDED.name,
-			email = EXCLUDED.email,
-			updated_at = EXCLUDED.updated_at
-	`
-	_, err := r.secondaryDB.Exec(context.Background(), query, userId, name, email, createdAt, updatedAt)
-	return err
-}
-
-func (r *Replicator) deleteRecord(userId int32) error {
-	_, err := r.secondaryDB.Exec(context.Background(), "DELETE FROM users WHERE user_id = $1", userId)
-	return err
-}
-
 func (r *Replicator) HandleStatus(w http.ResponseWriter, req *http.Request) {
 	r.statusMu.RLock()
 	status := r.status
@@ -312,3 +274,23 @@ func (r *Replicator) HandleHealth(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
+
+func (r *Replicator) HandleLeader(w http.ResponseWriter, req *http.Request) {
+	var instanceID string
+	var leaderSince time.Time
+	err := r.primaryDB.QueryRow(req.Context(),
+		"SELECT instance_id, leader_since FROM replicator_leader WHERE lock_key = $1", r.config.LeaderLockKey,
+	).Scan(&instanceID, &leaderSince)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "no leader elected yet"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"leader_id":    instanceID,
+		"leader_since": leaderSince,
+	})
+}
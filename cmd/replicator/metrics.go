@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricRecordsReplicated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "replicator_records_replicated_total",
+		Help: "Total number of rows applied to the secondary database.",
+	})
+
+	metricErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "replicator_errors_total",
+		Help: "Total number of errors, labeled by the stage they occurred in.",
+	}, []string{"stage"})
+
+	metricLastSyncTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "replicator_last_sync_timestamp_seconds",
+		Help: "Unix timestamp of the last transaction applied to the secondary.",
+	})
+
+	metricLagBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "replicator_lag_bytes",
+		Help: "Bytes between the primary's current WAL position and the last LSN applied to the secondary.",
+	})
+
+	metricPollDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "replicator_poll_duration_seconds",
+		Help:    "Time taken to apply a single decoded transaction to the secondary database.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	metricUp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "replicator_up",
+		Help: "1 if the replication stream is currently connected, 0 otherwise.",
+	})
+)
+
+// HandleMetrics exposes the registered collectors in the Prometheus
+// exposition format for scraping.
+func (r *Replicator) HandleMetrics(w http.ResponseWriter, req *http.Request) {
+	promhttp.Handler().ServeHTTP(w, req)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+const (
+	outputPlugin        = "pgoutput"
+	standbyStatusPeriod = 10 * time.Second
+)
+
+// relation describes the shape of a table as published via pgoutput, keyed
+// by the relation ID pgoutput assigns for the lifetime of the connection.
+type relation struct {
+	namespace string
+	name      string
+	columns   []string
+}
+
+// replicationConn holds the state of a single logical replication stream:
+// the raw protocol connection, the decoded table shapes we've seen so far,
+// and the LSNs we need to track to ack progress back to the primary.
+type replicationConn struct {
+	conn         *pgconn.PgConn
+	relations    map[uint32]*relation
+	lastReceived pglogrepl.LSN
+	lastApplied  pglogrepl.LSN
+
+	// txStart/txChangeCount/batch track the transaction currently being
+	// streamed: batch accumulates its row changes per destination table
+	// so they can be flushed to the secondary in bulk once the matching
+	// Commit message arrives, instead of one round trip per row.
+	txStart       time.Time
+	txChangeCount int
+	batch         *batchSet
+}
+
+// replicationConnString adapts the pool connection string (a pgx keyword/
+// value DSN) for a raw pgconn connection in replication mode: it adds the
+// "replication=database" keyword with the required space separator and
+// strips "default_query_exec_mode", which pgxpool understands but
+// pgconn.Connect does not.
+func replicationConnString(primaryConnStr string) string {
+	s := strings.Replace(primaryConnStr, " default_query_exec_mode=simple_protocol", "", 1)
+	return s + " replication=database"
+}
+
+// connectReplication opens a physical connection to the primary in
+// replication mode and ensures the configured slot exists.
+func (r *Replicator) connectReplication(ctx context.Context) (*replicationConn, error) {
+	conn, err := pgconn.Connect(ctx, replicationConnString(r.config.PrimaryConnStr))
+	if err != nil {
+		return nil, fmt.Errorf("replication connect failed: %w", err)
+	}
+
+	sysident, err := pglogrepl.IdentifySystem(ctx, conn)
+	if err != nil {
+		conn.Close(ctx)
+		return nil, fmt.Errorf("identify system failed: %w", err)
+	}
+	logger.Info("logical replication connected",
+		"system_id", sysident.SystemID, "timeline", sysident.Timeline, "xlogpos", sysident.XLogPos.String())
+
+	if _, err := pglogrepl.CreateReplicationSlot(ctx, conn, r.config.SlotName, outputPlugin,
+		pglogrepl.CreateReplicationSlotOptions{Temporary: false, Mode: pglogrepl.LogicalReplication}); err != nil {
+		if !isSlotAlreadyExistsErr(err) {
+			conn.Close(ctx)
+			return nil, fmt.Errorf("create replication slot failed: %w", err)
+		}
+		logger.Info("replication slot already exists, reusing it", "slot", r.config.SlotName)
+	}
+
+	startLSN := r.lastConfirmedLSN()
+	pluginArgs := []string{
+		"proto_version '1'",
+		fmt.Sprintf("publication_names '%s'", r.config.PublicationName),
+	}
+	if err := pglogrepl.StartReplication(ctx, conn, r.config.SlotName, startLSN,
+		pglogrepl.StartReplicationOptions{PluginArgs: pluginArgs}); err != nil {
+		conn.Close(ctx)
+		return nil, fmt.Errorf("start replication failed: %w", err)
+	}
+
+	return &replicationConn{
+		conn:         conn,
+		relations:    make(map[uint32]*relation),
+		lastReceived: startLSN,
+		lastApplied:  startLSN,
+	}, nil
+}
+
+func isSlotAlreadyExistsErr(err error) bool {
+	pgErr, ok := err.(*pgconn.PgError)
+	return ok && pgErr.Code == "42710"
+}
+
+// lastConfirmedLSN returns the LSN to resume streaming from, falling back
+// to zero (let the server decide) when we have never applied anything.
+func (r *Replicator) lastConfirmedLSN() pglogrepl.LSN {
+	r.statusMu.RLock()
+	defer r.statusMu.RUnlock()
+	lsn, err := pglogrepl.ParseLSN(r.status.LastLSN)
+	if err != nil {
+		return 0
+	}
+	return lsn
+}
+
+// streamReplication is the main loop: it reads WAL messages off the
+// replication connection, applies decoded row changes to the secondary,
+// and periodically reports flush progress back to the primary.
+func (r *Replicator) streamReplication(ctx context.Context, rc *replicationConn) error {
+	defer rc.conn.Close(context.Background())
+
+	nextStandbyDeadline := time.Now().Add(standbyStatusPeriod)
+
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if time.Now().After(nextStandbyDeadline) {
+			if err := r.sendStandbyStatus(ctx, rc); err != nil {
+				return fmt.Errorf("standby status update failed: %w", err)
+			}
+			nextStandbyDeadline = time.Now().Add(standbyStatusPeriod)
+		}
+
+		recvCtx, cancel := context.WithDeadline(ctx, nextStandbyDeadline)
+		msg, err := rc.conn.ReceiveMessage(recvCtx)
+		cancel()
+		if err != nil {
+			if pgconn.Timeout(err) {
+				continue
+			}
+			return fmt.Errorf("receive message failed: %w", err)
+		}
+
+		switch m := msg.(type) {
+		case *pgproto3.CopyData:
+			if err := r.handleCopyData(ctx, rc, m.Data); err != nil {
+				return err
+			}
+		default:
+			logger.Warn("unexpected replication message type", "type", fmt.Sprintf("%T", msg))
+		}
+	}
+}
+
+func (r *Replicator) handleCopyData(ctx context.Context, rc *replicationConn, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	switch data[0] {
+	case pglogrepl.PrimaryKeepaliveMessageByteID:
+		kam, err := pglogrepl.ParsePrimaryKeepaliveMessage(data[1:])
+		if err != nil {
+			return fmt.Errorf("parse keepalive failed: %w", err)
+		}
+		if kam.ServerWALEnd > rc.lastReceived {
+			rc.lastReceived = kam.ServerWALEnd
+		}
+		metricLagBytes.Set(float64(rc.lastReceived - rc.lastApplied))
+		if kam.ReplyRequested {
+			return r.sendStandbyStatus(ctx, rc)
+		}
+		return nil
+
+	case pglogrepl.XLogDataByteID:
+		xld, err := pglogrepl.ParseXLogData(data[1:])
+		if err != nil {
+			return fmt.Errorf("parse xlog data failed: %w", err)
+		}
+		if xld.WALStart > rc.lastReceived {
+			rc.lastReceived = xld.WALStart
+		}
+		return r.applyWALMessage(ctx, rc, xld)
+
+	default:
+		return nil
+	}
+}
+
+// applyWALMessage decodes a single pgoutput message and, for row changes,
+// applies it to the secondary database.
+func (r *Replicator) applyWALMessage(ctx context.Context, rc *replicationConn, xld pglogrepl.XLogData) error {
+	msg, err := pglogrepl.Parse(xld.WALData)
+	if err != nil {
+		return fmt.Errorf("decode pgoutput message failed: %w", err)
+	}
+
+	switch m := msg.(type) {
+	case *pglogrepl.RelationMessage:
+		cols := make([]string, len(m.Columns))
+		for i, c := range m.Columns {
+			cols[i] = c.Name
+		}
+		rc.relations[m.RelationID] = &relation{
+			namespace: m.Namespace,
+			name:      m.RelationName,
+			columns:   cols,
+		}
+
+	case *pglogrepl.InsertMessage:
+		staged, err := r.stageTupleChange(rc, m.RelationID, nil, m.Tuple, "INSERT")
+		if err != nil {
+			metricErrors.WithLabelValues("apply").Inc()
+			return err
+		}
+		if staged {
+			rc.txChangeCount++
+		}
+
+	case *pglogrepl.UpdateMessage:
+		staged, err := r.stageTupleChange(rc, m.RelationID, m.OldTuple, m.NewTuple, "UPDATE")
+		if err != nil {
+			metricErrors.WithLabelValues("apply").Inc()
+			return err
+		}
+		if staged {
+			rc.txChangeCount++
+		}
+
+	case *pglogrepl.DeleteMessage:
+		staged, err := r.stageTupleChange(rc, m.RelationID, m.OldTuple, nil, "DELETE")
+		if err != nil {
+			metricErrors.WithLabelValues("apply").Inc()
+			return err
+		}
+		if staged {
+			rc.txChangeCount++
+		}
+
+	case *pglogrepl.CommitMessage:
+		if err := r.flushBatch(ctx, rc.batch); err != nil {
+			metricErrors.WithLabelValues("apply").Inc()
+			return fmt.Errorf("flush batch failed: %w", err)
+		}
+		duration := time.Since(rc.txStart)
+
+		// In dry-run mode flushBatch applied nothing, so lastApplied must
+		// stay pinned to the last real commit: advancing it here would
+		// feed a higher WALFlushPosition to sendStandbyStatus, which
+		// would let the primary reclaim WAL for changes that were never
+		// actually written to the secondary.
+		if !r.dryRun {
+			rc.lastApplied = m.CommitLSN
+
+			r.statusMu.Lock()
+			r.status.RecordsReplied += int64(rc.txChangeCount)
+			r.status.LastSyncTime = time.Now()
+			r.status.LastLSN = rc.lastApplied.String()
+			r.status.LastError = ""
+			r.statusMu.Unlock()
+
+			metricRecordsReplicated.Add(float64(rc.txChangeCount))
+			metricLastSyncTimestamp.Set(float64(time.Now().Unix()))
+			metricLagBytes.Set(float64(rc.lastReceived - rc.lastApplied))
+		}
+		metricPollDuration.Observe(duration.Seconds())
+
+		logger.Info("applied transaction",
+			"change_count", rc.txChangeCount,
+			"last_lsn", rc.lastApplied.String(),
+			"duration_ms", duration.Milliseconds(),
+			"dry_run", r.dryRun,
+		)
+		rc.txChangeCount = 0
+		rc.batch = nil
+
+	case *pglogrepl.BeginMessage:
+		rc.txStart = time.Now()
+		rc.txChangeCount = 0
+		rc.batch = newBatchSet()
+	}
+
+	return nil
+}
+
+// stageTupleChange maps a decoded tuple onto its registered TableMapping,
+// if any, and stages it into the transaction's batch for this connection
+// to be applied in bulk once the Commit message arrives. The returned bool
+// reports whether a change was actually staged, so the caller can keep
+// txChangeCount - and the records-replicated counters derived from it -
+// limited to tables that are actually part of the replication config.
+func (r *Replicator) stageTupleChange(rc *replicationConn, relID uint32, oldTuple, newTuple *pglogrepl.TupleData, op string) (bool, error) {
+	rel, ok := rc.relations[relID]
+	if !ok {
+		return false, fmt.Errorf("received change for unknown relation %d", relID)
+	}
+
+	mapping, ok := r.mappings[rel.name]
+	if !ok {
+		return false, nil // table isn't in the replication config
+	}
+
+	if rc.batch == nil {
+		rc.batch = newBatchSet()
+	}
+
+	if op == "DELETE" {
+		if err := stageDelete(rc.batch, mapping, decodeTuple(rel.columns, oldTuple)); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if err := stageUpsert(rc.batch, mapping, decodeTuple(rel.columns, newTuple)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *Replicator) sendStandbyStatus(ctx context.Context, rc *replicationConn) error {
+	err := pglogrepl.SendStandbyStatusUpdate(ctx, rc.conn, pglogrepl.StandbyStatusUpdate{
+		WALWritePosition: rc.lastReceived,
+		WALFlushPosition: rc.lastApplied,
+		WALApplyPosition: rc.lastApplied,
+		ClientTime:       time.Now(),
+		ReplyRequested:   false,
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
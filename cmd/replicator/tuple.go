@@ -0,0 +1,28 @@
+package main
+
+import "github.com/jackc/pglogrepl"
+
+// decodeTuple zips a relation's column names with the text-encoded values
+// pgoutput sent for a row. A column is omitted from the result entirely
+// when pgoutput reported it as TOASTed-and-unchanged (meaning "don't touch
+// this column"); an explicit SQL NULL is represented as a present key with
+// a nil value.
+func decodeTuple(columns []string, tuple *pglogrepl.TupleData) map[string]*string {
+	values := make(map[string]*string, len(columns))
+	if tuple == nil {
+		return values
+	}
+	for i, col := range tuple.Columns {
+		if i >= len(columns) {
+			break
+		}
+		switch col.DataType {
+		case pglogrepl.TupleDataTypeText:
+			s := string(col.Data)
+			values[columns[i]] = &s
+		case pglogrepl.TupleDataTypeNull:
+			values[columns[i]] = nil
+		}
+	}
+	return values
+}